@@ -2,12 +2,17 @@ package common
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -23,14 +28,134 @@ type ClientConfig struct {
 	LoopAmount     int
 	LoopPeriod     time.Duration
 	BatchMaxAmount int
+	// GzipThreshold is the minimum uncompressed batch body size, in
+	// bytes, above which a batch is gzipped before being sent. Only
+	// takes effect if the server also advertised gzip support in its
+	// HELLO response.
+	GzipThreshold int
 }
 
-// Client Entity that encapsulates how
+// pendingResult is what the dispatcher goroutine hands back to whoever
+// is waiting on a given request id: either the response payload, or the
+// error that tore down the connection before a response arrived.
+type pendingResult struct {
+	payload []byte
+	err     error
+}
+
+// subscription decouples a topic's MESSAGE deliveries from the shared
+// connection's single reader goroutine. push is called from
+// dispatchResponses and must never block, since a stalled Subscribe
+// consumer would otherwise stall every other in-flight response on the
+// connection; it just appends to an internal queue drained by this
+// subscription's own goroutine, which is the only one that ever blocks
+// sending into Out.
+type subscription struct {
+	Out <-chan []byte
+
+	out    chan<- []byte
+	notify chan struct{}
+
+	mu     sync.Mutex
+	queue  [][]byte
+	closed bool
+}
+
+// newSubscription allocates a subscription and starts its delivery
+// goroutine.
+func newSubscription() *subscription {
+	ch := make(chan []byte)
+	s := &subscription{
+		Out:    ch,
+		out:    ch,
+		notify: make(chan struct{}, 1),
+	}
+	go s.run()
+	return s
+}
+
+// push enqueues data for delivery without ever blocking the caller.
+func (s *subscription) push(data []byte) {
+	s.mu.Lock()
+	s.queue = append(s.queue, data)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the delivery goroutine once its queue has drained and
+// closes Out, signalling to consumers that no more MESSAGE frames will
+// arrive.
+func (s *subscription) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued items to Out one at a time, blocking on a slow
+// consumer only here rather than in the shared connection's reader.
+func (s *subscription) run() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			if s.closed {
+				s.mu.Unlock()
+				close(s.out)
+				return
+			}
+			s.mu.Unlock()
+			<-s.notify
+			continue
+		}
+		item := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		s.out <- item
+	}
+}
+
+// Client Entity that encapsulates how the agency talks to the server
+// over a single, long-lived, multiplexed connection.
 type Client struct {
 	config ClientConfig
 	conn   net.Conn
+
+	nextRequestID uint32
+	pendingMu     sync.Mutex
+	pending       map[uint32]chan pendingResult
+	// dispatchDone and dispatchErr record that dispatchResponses has
+	// exited and why, so registerPending can fail fast instead of
+	// handing out a channel nothing will ever deliver to. Guarded by
+	// pendingMu.
+	dispatchDone bool
+	dispatchErr  error
+
+	subsMu sync.Mutex
+	subs   map[string]*subscription
+
+	serverSupportsGzip bool
+
+	// nextBatchSeq holds the last batch sequence number assigned; the
+	// next call to nextBatchSeqNum returns it incremented by one.
+	nextBatchSeq uint64
+
+	// checkpointDir overrides where the checkpoint file is stored;
+	// empty means the default "/.data". Only tests set this.
+	checkpointDir string
 }
 
+// clientCapabilities is what this client advertises in its HELLO frame.
+const clientCapabilities = "gzip,binary"
+
 // NewClient Initializes a new client receiving the configuration
 // as a parameter
 func NewClient(config ClientConfig) *Client {
@@ -78,8 +203,32 @@ func (c *Client) cleanup() {
 	}
 }
 
-// StartClientLoop Load bets from CSV file and send them in batches using streaming approach
+// StartClientLoop Load bets from CSV file and send them in batches over a
+// single, long-lived connection to the server
 func (c *Client) StartClientLoop() {
+	err := c.createClientSocket()
+	if err != nil {
+		return
+	}
+	defer c.cleanup()
+
+	c.pending = make(map[uint32]chan pendingResult)
+	c.subs = make(map[string]*subscription)
+	go c.dispatchResponses()
+
+	err = c.negotiateCapabilities()
+	if err != nil {
+		log.Errorf("action: negotiate_capabilities | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return
+	}
+
+	resumeSeq, err := c.resumeSession()
+	if err != nil {
+		log.Errorf("action: resume_session | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return
+	}
+	c.nextBatchSeq = resumeSeq
+
 	filename := fmt.Sprintf("/.data/agency-%s.csv", c.config.ID)
 	file, err := os.Open(filename)
 	if err != nil {
@@ -93,12 +242,23 @@ func (c *Client) StartClientLoop() {
 	batchCount := 0
 	totalBetsSent := 0
 
+	if resumeSeq > 0 {
+		rowsToSkip := int(resumeSeq) * batchSize
+		skipped, err := c.skipRows(reader, rowsToSkip)
+		if err != nil {
+			log.Errorf("action: resume_session | result: fail | client_id: %v | error: %v", c.config.ID, err)
+			return
+		}
+		log.Infof("action: resume_session | result: success | client_id: %v | resume_seq: %d | rows_skipped: %d",
+			c.config.ID, resumeSeq, skipped)
+	}
+
 	log.Infof("action: start_streaming | result: success | client_id: %v | batch_size: %d", c.config.ID, batchSize)
 
 	for {
 		batch, err := c.readNextBatch(reader, batchSize)
 		if err != nil {
-			log.Errorf("action: read_batch | result: fail | client_id: %v | batch_count: %d | error: %v", 
+			log.Errorf("action: read_batch | result: fail | client_id: %v | batch_count: %d | error: %v",
 				c.config.ID, batchCount, err)
 			return
 		}
@@ -109,7 +269,7 @@ func (c *Client) StartClientLoop() {
 
 		err = c.sendBatch(batch)
 		if err != nil {
-			log.Errorf("action: send_batch | result: fail | client_id: %v | batch_count: %d | batch_size: %d | error: %v", 
+			log.Errorf("action: send_batch | result: fail | client_id: %v | batch_count: %d | batch_size: %d | error: %v",
 				c.config.ID, batchCount, len(batch), err)
 			return
 		}
@@ -122,14 +282,27 @@ func (c *Client) StartClientLoop() {
 		}
 	}
 
-	log.Infof("action: loop_finished | result: success | client_id: %v | total_batches_sent: %d | total_bets_sent: %d", 
+	log.Infof("action: loop_finished | result: success | client_id: %v | total_batches_sent: %d | total_bets_sent: %d",
 		c.config.ID, batchCount, totalBetsSent)
+
+	if err := c.sendFinishBets(); err != nil {
+		log.Errorf("action: finish_bets | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return
+	}
+	log.Infof("action: finish_bets | result: success | client_id: %v", c.config.ID)
+
+	winners, err := c.queryWinners()
+	if err != nil {
+		log.Errorf("action: query_winners | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return
+	}
+	log.Infof("action: query_winners | result: success | client_id: %v | winners: %s", c.config.ID, winners)
 }
 
 // readNextBatch reads the next batch of bets from the CSV reader
 func (c *Client) readNextBatch(reader *csv.Reader, batchSize int) ([]Bet, error) {
 	var batch []Bet
-	
+
 	for len(batch) < batchSize {
 		record, err := reader.Read()
 		if err == io.EOF {
@@ -138,11 +311,11 @@ func (c *Client) readNextBatch(reader *csv.Reader, batchSize int) ([]Bet, error)
 		if err != nil {
 			return nil, err
 		}
-		
+
 		if len(record) != 5 {
 			continue // Skip malformed records
 		}
-		
+
 		bet := Bet{
 			Agency:    c.config.ID,
 			FirstName: strings.Split(record[0], " ")[0],
@@ -153,44 +326,407 @@ func (c *Client) readNextBatch(reader *csv.Reader, batchSize int) ([]Bet, error)
 		}
 		batch = append(batch, bet)
 	}
-	
+
 	return batch, nil
 }
 
-// sendBatch sends a batch of bets to the server without waiting for response
+// skipRows discards up to n already-sent rows from reader, so the
+// streaming loop resumes right after the last batch the server
+// acknowledged.
+func (c *Client) skipRows(reader *csv.Reader, n int) (int, error) {
+	skipped := 0
+	for skipped < n {
+		_, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return skipped, err
+		}
+		skipped++
+	}
+	return skipped, nil
+}
+
+// checkpointPath is where this agency's highest-acknowledged batch
+// sequence number is persisted between runs.
+func (c *Client) checkpointPath() string {
+	dir := c.checkpointDir
+	if dir == "" {
+		dir = "/.data"
+	}
+	return fmt.Sprintf("%s/agency-%s.checkpoint", dir, c.config.ID)
+}
+
+// readCheckpoint returns the highest batch sequence number this client
+// previously recorded as acknowledged, or 0 if no checkpoint exists yet.
+// A checkpoint that fails to parse (e.g. left truncated by a crash mid
+// write) is treated the same as a missing one: the RESUME handshake's
+// authoritative server answer is what actually matters, so a corrupt
+// local file must never abort the client run.
+func (c *Client) readCheckpoint() (uint64, error) {
+	data, err := os.ReadFile(c.checkpointPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		log.Errorf("action: read_checkpoint | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return 0, nil
+	}
+	return seq, nil
+}
+
+// writeCheckpoint persists seq as the highest batch sequence number
+// acknowledged so far, so a future run can resume after it. It writes to
+// a temporary file and renames it into place, so a crash or SIGTERM
+// (handled concurrently in NewClient) can never leave a truncated,
+// unparseable checkpoint behind: the rename is atomic, so readers only
+// ever see the old complete file or the new complete file.
+func (c *Client) writeCheckpoint(seq uint64) error {
+	path := c.checkpointPath()
+	tmpPath := fmt.Sprintf("%s.tmp-%d", path, seq)
+
+	if err := os.WriteFile(tmpPath, []byte(strconv.FormatUint(seq, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// resumeSession reads the local checkpoint and exchanges a RESUME frame
+// with the server, which tells the client the correct point to resume
+// from if the local checkpoint is missing or stale. It returns the
+// sequence number of the last batch the server has already applied.
+func (c *Client) resumeSession() (uint64, error) {
+	localSeq, err := c.readCheckpoint()
+	if err != nil {
+		return 0, err
+	}
+
+	proto := Protocol{}
+	reqID := c.nextReqID()
+	respCh, err := c.registerPending(reqID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.writeFrame(proto.SerializeResume(reqID, c.config.ID, localSeq))
+	if err != nil {
+		c.abandonPending(reqID)
+		return 0, err
+	}
+
+	result := <-respCh
+	if result.err != nil {
+		return 0, result.err
+	}
+
+	_, resumeSeq, err := proto.DeserializeResume(result.payload)
+	return resumeSeq, err
+}
+
+// nextBatchSeqNum returns the next monotonically increasing batch
+// sequence number to assign.
+func (c *Client) nextBatchSeqNum() uint64 {
+	return atomic.AddUint64(&c.nextBatchSeq, 1)
+}
+
+// negotiateCapabilities exchanges a HELLO frame with the server once, at
+// connection setup, and records which optional features it supports.
+func (c *Client) negotiateCapabilities() error {
+	proto := Protocol{}
+	reqID := c.nextReqID()
+	respCh, err := c.registerPending(reqID)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeFrame(proto.SerializeHello(reqID, c.config.ID, clientCapabilities))
+	if err != nil {
+		c.abandonPending(reqID)
+		return err
+	}
+
+	result := <-respCh
+	if result.err != nil {
+		return result.err
+	}
+
+	_, capabilities, err := proto.DeserializeHello(result.payload)
+	if err != nil {
+		return err
+	}
+
+	c.serverSupportsGzip = slices.Contains(strings.Split(capabilities, ","), "gzip")
+	log.Infof("action: negotiate_capabilities | result: success | client_id: %v | server_gzip: %v",
+		c.config.ID, c.serverSupportsGzip)
+	return nil
+}
+
+// sendBatch sends a batch of bets over the shared connection and waits
+// for the server to acknowledge that specific request. Batches whose
+// uncompressed body is larger than GzipThreshold are gzipped first, as
+// long as the server advertised gzip support during negotiation.
 func (c *Client) sendBatch(bets []Bet) error {
-	err := c.createClientSocket()
+	proto := Protocol{}
+	reqID := c.nextReqID()
+	seq := c.nextBatchSeqNum()
+	respCh, err := c.registerPending(reqID)
 	if err != nil {
+		log.Errorf("action: send_batch | result: fail | client_id: %v | error: %v",
+			c.config.ID, err)
 		return err
 	}
-	defer c.cleanup()
 
+	compress := c.serverSupportsGzip && len(batchBody(bets)) > c.config.GzipThreshold
+	err = c.writeFrame(proto.SerializeBatch(reqID, seq, bets, compress))
+	if err != nil {
+		c.abandonPending(reqID)
+		log.Errorf("action: send_batch | result: fail | client_id: %v | error: %v",
+			c.config.ID, err)
+		return err
+	}
+
+	result := <-respCh
+	if result.err != nil {
+		log.Errorf("action: send_batch | result: fail | client_id: %v | error: %v",
+			c.config.ID, result.err)
+		return result.err
+	}
+
+	if err := c.writeCheckpoint(seq); err != nil {
+		log.Errorf("action: write_checkpoint | result: fail | client_id: %v | seq: %d | error: %v",
+			c.config.ID, seq, err)
+	}
+
+	log.Infof("action: batch_enviado | result: success | cantidad: %d", len(bets))
+	return nil
+}
+
+// sendFinishBets notifies the server that this agency has no more bets
+// to send, over the shared connection, and waits for its ack.
+func (c *Client) sendFinishBets() error {
 	proto := Protocol{}
-	batchMessage := proto.SerializeBatch(bets)
-	messageBytes := []byte(batchMessage)
-	
+	reqID := c.nextReqID()
+	respCh, err := c.registerPending(reqID)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeFrame(proto.SerializeFinishBets(reqID, c.config.ID))
+	if err != nil {
+		c.abandonPending(reqID)
+		return err
+	}
+
+	result := <-respCh
+	return result.err
+}
+
+// queryWinners asks the server for this agency's winners over the
+// shared connection and returns the raw response payload.
+func (c *Client) queryWinners() ([]byte, error) {
+	proto := Protocol{}
+	reqID := c.nextReqID()
+	respCh, err := c.registerPending(reqID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.writeFrame(proto.SerializeQueryWinners(reqID, c.config.ID))
+	if err != nil {
+		c.abandonPending(reqID)
+		return nil, err
+	}
+
+	result := <-respCh
+	if result.err != nil {
+		return nil, result.err
+	}
+	return result.payload, nil
+}
+
+// Subscribe registers this agency as a subscriber of topic and returns a
+// channel that receives the raw payload of each MESSAGE frame the server
+// publishes to it, instead of having to poll with queryWinners. The
+// channel is closed once the shared connection goes down.
+func (c *Client) Subscribe(topic string) (<-chan []byte, error) {
+	proto := Protocol{}
+	reqID := c.nextReqID()
+	respCh, err := c.registerPending(reqID)
+	if err != nil {
+		return nil, err
+	}
+	sub := c.registerSubscription(topic)
+
+	err = c.writeFrame(proto.SerializeSubscribe(reqID, c.config.ID, topic))
+	if err != nil {
+		c.abandonPending(reqID)
+		c.unregisterSubscription(topic)
+		return nil, err
+	}
+
+	result := <-respCh
+	if result.err != nil {
+		c.unregisterSubscription(topic)
+		return nil, result.err
+	}
+
+	return sub.Out, nil
+}
+
+// registerSubscription allocates the subscription that will receive
+// every MESSAGE frame published to topic.
+func (c *Client) registerSubscription(topic string) *subscription {
+	sub := newSubscription()
+	c.subsMu.Lock()
+	c.subs[topic] = sub
+	c.subsMu.Unlock()
+	return sub
+}
+
+// unregisterSubscription stops routing MESSAGE frames for topic to their
+// subscription, e.g. after a failed SUBSCRIBE.
+func (c *Client) unregisterSubscription(topic string) {
+	c.subsMu.Lock()
+	sub, ok := c.subs[topic]
+	delete(c.subs, topic)
+	c.subsMu.Unlock()
+	if ok {
+		sub.close()
+	}
+}
+
+// writeFrame writes a complete frame to the shared connection, retrying
+// on short writes.
+func (c *Client) writeFrame(frameBytes []byte) error {
 	totalWritten := 0
-	for totalWritten < len(messageBytes) {
-		n, err := c.conn.Write(messageBytes[totalWritten:])
+	for totalWritten < len(frameBytes) {
+		n, err := c.conn.Write(frameBytes[totalWritten:])
 		if err != nil {
-			log.Errorf("action: send_batch | result: fail | client_id: %v | error: %v",
-				c.config.ID, err)
 			return err
 		}
 		totalWritten += n
 	}
-
-	log.Infof("action: batch_enviado | result: success | cantidad: %d", len(bets))
 	return nil
 }
 
+// nextReqID returns the next unique request id for this connection.
+func (c *Client) nextReqID() uint32 {
+	return atomic.AddUint32(&c.nextRequestID, 1)
+}
+
+// registerPending allocates the channel that will receive the response
+// matching reqID once the dispatcher goroutine reads it off the wire.
+// It fails fast with the error that brought the connection down if
+// dispatchResponses has already exited, since no goroutine is left to
+// ever deliver to the channel it would otherwise hand back.
+func (c *Client) registerPending(reqID uint32) (chan pendingResult, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if c.dispatchDone {
+		return nil, c.dispatchErr
+	}
+	ch := make(chan pendingResult, 1)
+	c.pending[reqID] = ch
+	return ch, nil
+}
 
-// receiveResponse waits for server response
-func (c *Client) receiveResponse() (string, error) {
-	buffer := make([]byte, 1024)
-	n, err := c.conn.Read(buffer)
+// abandonPending removes a pending request that will never be answered,
+// e.g. because writing it to the connection failed.
+func (c *Client) abandonPending(reqID uint32) {
+	c.pendingMu.Lock()
+	delete(c.pending, reqID)
+	c.pendingMu.Unlock()
+}
+
+// dispatchResponses reads framed responses off the shared connection for
+// as long as it stays open, routing each one to the channel registered
+// for its request id. Since batches, FINISH_BETS and QUERY_WINNERS can
+// all be in flight at once, responses may arrive in a different order
+// than the requests were sent; the request id is what lets each caller
+// find its own response without blocking on the others.
+func (c *Client) dispatchResponses() {
+	proto := Protocol{}
+
+	for {
+		msgType, reqID, payload, err := ReadFrame(c.conn)
+		if err != nil {
+			c.failAllPending(err)
+			c.closeAllSubscriptions()
+			return
+		}
+
+		if msgType == MsgTypeMessage {
+			c.dispatchMessage(proto, payload)
+			continue
+		}
+
+		c.pendingMu.Lock()
+		ch, ok := c.pending[reqID]
+		if ok {
+			delete(c.pending, reqID)
+		}
+		c.pendingMu.Unlock()
+
+		if ok {
+			ch <- pendingResult{payload: payload}
+		} else {
+			log.Errorf("action: dispatch_response | result: fail | client_id: %v | error: unknown request id %d",
+				c.config.ID, reqID)
+		}
+	}
+}
+
+// dispatchMessage routes a MESSAGE frame's payload to the subscription
+// registered for its topic, if this client is still subscribed to it.
+// subscription.push never blocks, so a stalled Subscribe consumer cannot
+// back up the shared connection's reader.
+func (c *Client) dispatchMessage(proto Protocol, payload []byte) {
+	topic, data, err := proto.DeserializeMessage(payload)
 	if err != nil {
-		return "", err
+		log.Errorf("action: dispatch_message | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return
 	}
-	return strings.TrimSpace(string(buffer[:n])), nil
-}
\ No newline at end of file
+
+	c.subsMu.Lock()
+	sub, ok := c.subs[topic]
+	c.subsMu.Unlock()
+
+	if !ok {
+		log.Errorf("action: dispatch_message | result: fail | client_id: %v | error: no subscriber for topic %s",
+			c.config.ID, topic)
+		return
+	}
+
+	sub.push(data)
+}
+
+// failAllPending unblocks every caller still waiting on a response with
+// err, typically because the connection was lost or closed, and marks
+// the dispatcher as done so any request that comes in afterwards fails
+// fast in registerPending instead of hanging forever.
+func (c *Client) failAllPending(err error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.dispatchDone = true
+	c.dispatchErr = err
+	for reqID, ch := range c.pending {
+		ch <- pendingResult{err: err}
+		delete(c.pending, reqID)
+	}
+}
+
+// closeAllSubscriptions closes every subscription, signalling to
+// consumers that no further MESSAGE frames will arrive.
+func (c *Client) closeAllSubscriptions() {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	for topic, sub := range c.subs {
+		sub.close()
+		delete(c.subs, topic)
+	}
+}
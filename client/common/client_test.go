@@ -0,0 +1,202 @@
+package common
+
+import (
+	"encoding/csv"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDispatchResponsesRoutesOutOfOrder checks that dispatchResponses
+// matches each frame to the channel registered for its request id, even
+// when responses arrive in a different order than the requests that
+// triggered them were sent.
+func TestDispatchResponsesRoutesOutOfOrder(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	c := &Client{config: ClientConfig{ID: "1"}, conn: clientConn}
+	c.pending = make(map[uint32]chan pendingResult)
+	c.subs = make(map[string]*subscription)
+
+	chOne, err := c.registerPending(1)
+	if err != nil {
+		t.Fatalf("registerPending(1): %v", err)
+	}
+	chTwo, err := c.registerPending(2)
+	if err != nil {
+		t.Fatalf("registerPending(2): %v", err)
+	}
+
+	go c.dispatchResponses()
+
+	// Send the response for request 2 before the response for request 1,
+	// even though a caller would typically have sent request 1 first.
+	go func() {
+		serverConn.Write(frame(MsgTypeQueryWinners, 2, []byte("two")))
+		serverConn.Write(frame(MsgTypeQueryWinners, 1, []byte("one")))
+	}()
+
+	resultOne := recvResult(t, chOne)
+	resultTwo := recvResult(t, chTwo)
+
+	if string(resultOne.payload) != "one" {
+		t.Fatalf("request 1 payload = %q, want %q", resultOne.payload, "one")
+	}
+	if string(resultTwo.payload) != "two" {
+		t.Fatalf("request 2 payload = %q, want %q", resultTwo.payload, "two")
+	}
+}
+
+func recvResult(t *testing.T, ch chan pendingResult) pendingResult {
+	t.Helper()
+	select {
+	case result := <-ch:
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for dispatched response")
+		return pendingResult{}
+	}
+}
+
+// TestRegisterPendingFailsFastAfterDispatcherExits checks that once
+// dispatchResponses has returned (e.g. because the peer closed the
+// connection), a later registerPending call fails immediately with the
+// error that brought the connection down, instead of handing back a
+// channel nothing will ever deliver to.
+func TestRegisterPendingFailsFastAfterDispatcherExits(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	c := &Client{config: ClientConfig{ID: "1"}, conn: clientConn}
+	c.pending = make(map[uint32]chan pendingResult)
+	c.subs = make(map[string]*subscription)
+
+	done := make(chan struct{})
+	go func() {
+		c.dispatchResponses()
+		close(done)
+	}()
+
+	serverConn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for dispatchResponses to exit after peer closed")
+	}
+
+	if _, err := c.registerPending(1); err == nil {
+		t.Fatal("registerPending() after dispatcher exit = nil error, want the connection error")
+	}
+}
+
+// TestReadCheckpointTreatsCorruptFileAsZero checks that a checkpoint file
+// left truncated or otherwise unparseable by a crash mid write is treated
+// the same as a missing checkpoint, rather than aborting the client run.
+func TestReadCheckpointTreatsCorruptFileAsZero(t *testing.T) {
+	c := &Client{config: ClientConfig{ID: "1"}, checkpointDir: t.TempDir()}
+
+	if err := os.WriteFile(c.checkpointPath(), []byte("3"), 0644); err != nil {
+		t.Fatalf("seed checkpoint: %v", err)
+	}
+	if err := os.WriteFile(c.checkpointPath(), []byte("not-a-number"), 0644); err != nil {
+		t.Fatalf("corrupt checkpoint: %v", err)
+	}
+
+	seq, err := c.readCheckpoint()
+	if err != nil {
+		t.Fatalf("readCheckpoint returned error for corrupt file: %v", err)
+	}
+	if seq != 0 {
+		t.Fatalf("readCheckpoint() = %d, want 0 for corrupt file", seq)
+	}
+}
+
+// TestWriteCheckpointSurvivesCrashBeforeRename checks that a simulated
+// crash between the temp-file write and the rename into place never
+// corrupts the previously committed checkpoint: readers only ever see
+// the old complete file or the new complete file, never a partial one.
+func TestWriteCheckpointSurvivesCrashBeforeRename(t *testing.T) {
+	c := &Client{config: ClientConfig{ID: "1"}, checkpointDir: t.TempDir()}
+
+	if err := c.writeCheckpoint(5); err != nil {
+		t.Fatalf("writeCheckpoint(5): %v", err)
+	}
+
+	// Simulate a crash that writes the next checkpoint's temp file but
+	// never reaches the rename: leave a stale tmp file behind and
+	// confirm it is invisible to readers.
+	stalePath := c.checkpointPath() + ".tmp-6"
+	if err := os.WriteFile(stalePath, []byte("6"), 0644); err != nil {
+		t.Fatalf("seed stale tmp file: %v", err)
+	}
+
+	seq, err := c.readCheckpoint()
+	if err != nil {
+		t.Fatalf("readCheckpoint: %v", err)
+	}
+	if seq != 5 {
+		t.Fatalf("readCheckpoint() = %d, want 5 (crash before rename must not advance the checkpoint)", seq)
+	}
+
+	entries, err := os.ReadDir(c.checkpointDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("checkpoint dir has %d entries, want 2 (real checkpoint + stale tmp file)", len(entries))
+	}
+}
+
+// TestSkipRowsAdvancesPastAcknowledgedRows checks that skipRows discards
+// exactly the rows covered by previously acknowledged batches, leaving
+// the reader positioned at the first row of the next unsent batch.
+func TestSkipRowsAdvancesPastAcknowledgedRows(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agency.csv")
+
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	for i := 1; i <= 10; i++ {
+		row := []string{"Name Last", "Last", "doc" + strconv.Itoa(i), "1990-01-01", strconv.Itoa(i)}
+		if err := w.Write(row); err != nil {
+			t.Fatalf("write row: %v", err)
+		}
+	}
+	w.Flush()
+	if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+		t.Fatalf("write csv: %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open csv: %v", err)
+	}
+	defer file.Close()
+
+	c := &Client{config: ClientConfig{ID: "1"}}
+	reader := csv.NewReader(file)
+
+	// Two batches of 3 rows already acknowledged: skip the first 6 rows.
+	skipped, err := c.skipRows(reader, 6)
+	if err != nil {
+		t.Fatalf("skipRows: %v", err)
+	}
+	if skipped != 6 {
+		t.Fatalf("skipRows() skipped = %d, want 6", skipped)
+	}
+
+	record, err := reader.Read()
+	if err != nil {
+		t.Fatalf("read next row after skip: %v", err)
+	}
+	if record[4] != "7" {
+		t.Fatalf("first row after skip has Number %q, want %q (row 7)", record[4], "7")
+	}
+}
@@ -1,6 +1,33 @@
 package common
 
-import "fmt"
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message type identifiers used in the 1-byte type field of each frame.
+const (
+	MsgTypeBet          byte = 1
+	MsgTypeBatch        byte = 2
+	MsgTypeFinishBets   byte = 3
+	MsgTypeQueryWinners byte = 4
+	MsgTypeSubscribe    byte = 5
+	MsgTypePublish      byte = 6
+	MsgTypeMessage      byte = 7
+	MsgTypeHello        byte = 8
+	MsgTypeResume       byte = 9
+)
+
+// Batch body compression markers, stored in the 1-byte flag that
+// precedes a BATCH frame's lengths.
+const (
+	batchBodyRaw  byte = 0
+	batchBodyGzip byte = 1
+)
 
 // Bet represents a lottery bet with all required participant information
 type Bet struct {
@@ -12,60 +39,449 @@ type Bet struct {
 	Number    string // Lottery number being bet on
 }
 
-// Protocol handles BET message serialization for client-server communication
+// Protocol handles message framing and (de)serialization for
+// client-server communication.
+//
+// Every message is a length-prefixed binary frame:
+//
+//	4 bytes  big-endian length of (type + request id + payload)
+//	1 byte   message type (one of the MsgType* constants)
+//	4 bytes  big-endian request id, echoed back on the matching response
+//	N bytes  payload, mostly made up of TLV-encoded fields
+//
+// The request id lets a single connection carry several in-flight
+// requests at once: a client assigns each outgoing request a unique id
+// and matches it against the id on the frame the server eventually sends
+// back, regardless of the order responses arrive in.
+//
+// Each TLV field is a 2-byte big-endian length followed by that many raw
+// bytes, so field values may contain arbitrary bytes (including
+// non-ASCII names) without any escaping. PUBLISH and MESSAGE data use a
+// 4-byte length instead (see putTLV32), and the sequence numbers and
+// lengths in BATCH and RESUME payloads are fixed-width big-endian
+// integers rather than TLV fields.
 type Protocol struct{}
 
-// escape protects special characters in strings for safe transmission.
-// It escapes backslashes and hash symbols to prevent parsing conflicts.
-func (Protocol) escape(s string) string {
-	out := make([]rune, 0, len(s))
-	for _, r := range s {
-		if r == '\\' || r == '#' {
-			out = append(out, '\\')
+// frame wraps a message type, request id and payload into a complete
+// frame, ready to be written to the wire.
+func frame(msgType byte, reqID uint32, payload []byte) []byte {
+	buf := make([]byte, 4+1+4+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+4+len(payload)))
+	buf[4] = msgType
+	binary.BigEndian.PutUint32(buf[5:9], reqID)
+	copy(buf[9:], payload)
+	return buf
+}
+
+// putTLV appends a length-prefixed field to buf.
+func putTLV(buf *bytes.Buffer, value string) {
+	var lenBytes [2]byte
+	binary.BigEndian.PutUint16(lenBytes[:], uint16(len(value)))
+	buf.Write(lenBytes[:])
+	buf.WriteString(value)
+}
+
+// getTLV reads a single length-prefixed field from payload starting at
+// offset, returning the field value and the offset of the field after it.
+func getTLV(payload []byte, offset int) (string, int, error) {
+	if offset+2 > len(payload) {
+		return "", 0, errors.New("protocol: truncated TLV length")
+	}
+	length := int(binary.BigEndian.Uint16(payload[offset : offset+2]))
+	offset += 2
+	if offset+length > len(payload) {
+		return "", 0, errors.New("protocol: truncated TLV value")
+	}
+	return string(payload[offset : offset+length]), offset + length, nil
+}
+
+// putTLV32 appends a 4-byte length-prefixed field to buf. Unlike putTLV's
+// 2-byte length, this supports values larger than 65535 bytes without
+// silently wrapping around to a shorter, corrupting length, which matters
+// for payloads such as published winner data whose size isn't bounded the
+// way a bet's name or document fields are.
+func putTLV32(buf *bytes.Buffer, value []byte) {
+	var lenBytes [4]byte
+	binary.BigEndian.PutUint32(lenBytes[:], uint32(len(value)))
+	buf.Write(lenBytes[:])
+	buf.Write(value)
+}
+
+// getTLV32 reads a single 4-byte length-prefixed field from payload
+// starting at offset, returning the field value and the offset of the
+// field after it.
+func getTLV32(payload []byte, offset int) ([]byte, int, error) {
+	if offset+4 > len(payload) {
+		return nil, 0, errors.New("protocol: truncated TLV32 length")
+	}
+	length := int(binary.BigEndian.Uint32(payload[offset : offset+4]))
+	offset += 4
+	if offset+length > len(payload) {
+		return nil, 0, errors.New("protocol: truncated TLV32 value")
+	}
+	return payload[offset : offset+length], offset + length, nil
+}
+
+// betPayload TLV-encodes a Bet's fields in wire order.
+func betPayload(b Bet) []byte {
+	var buf bytes.Buffer
+	putTLV(&buf, b.Agency)
+	putTLV(&buf, b.FirstName)
+	putTLV(&buf, b.LastName)
+	putTLV(&buf, b.Document)
+	putTLV(&buf, b.Birthdate)
+	putTLV(&buf, b.Number)
+	return buf.Bytes()
+}
+
+// deserializeBetPayload decodes a TLV-encoded Bet payload.
+func deserializeBetPayload(payload []byte) (Bet, error) {
+	values := make([]string, 0, 6)
+	offset := 0
+	for i := 0; i < 6; i++ {
+		value, next, err := getTLV(payload, offset)
+		if err != nil {
+			return Bet{}, err
 		}
-		out = append(out, r)
+		values = append(values, value)
+		offset = next
 	}
-	return string(out)
+	return Bet{
+		Agency:    values[0],
+		FirstName: values[1],
+		LastName:  values[2],
+		Document:  values[3],
+		Birthdate: values[4],
+		Number:    values[5],
+	}, nil
 }
 
-// SerializeBet converts a Bet struct into a formatted BET message string.
-// The message format is: BET#agency#first_name#last_name#document#birthdate#number
-// All fields are properly escaped to handle special characters safely.
-func (p Protocol) SerializeBet(b Bet) string {
-	return fmt.Sprintf("BET#%s#%s#%s#%s#%s#%s\n",
-		p.escape(b.Agency),
-		p.escape(b.FirstName),
-		p.escape(b.LastName),
-		p.escape(b.Document),
-		p.escape(b.Birthdate),
-		p.escape(b.Number),
-	)
+// SerializeBet encodes a single Bet as a complete BET frame carrying
+// reqID.
+func (p Protocol) SerializeBet(reqID uint32, b Bet) []byte {
+	return frame(MsgTypeBet, reqID, betPayload(b))
 }
 
-// SerializeBatch converts a slice of Bet structs into a formatted BATCH message string.
-// The message format is: BATCH#count\nBET#agency#first_name#last_name#document#birthdate#number\n...
-// This allows sending multiple bets in a single transmission for efficient batch processing.
-func (p Protocol) SerializeBatch(bets []Bet) string {
+// DeserializeBet decodes a BET frame's payload back into a Bet.
+func (p Protocol) DeserializeBet(payload []byte) (Bet, error) {
+	return deserializeBetPayload(payload)
+}
+
+// batchBody builds the uncompressed BATCH payload body: a 4-byte
+// big-endian bet count followed by, for each bet, a 4-byte big-endian
+// length and the bet's TLV-encoded fields, so a reader knows exactly how
+// many bytes to consume per bet without scanning for a separator.
+func batchBody(bets []Bet) []byte {
+	var buf bytes.Buffer
+	var countBytes [4]byte
+	binary.BigEndian.PutUint32(countBytes[:], uint32(len(bets)))
+	buf.Write(countBytes[:])
+
+	for _, bet := range bets {
+		betBytes := betPayload(bet)
+		var betLenBytes [4]byte
+		binary.BigEndian.PutUint32(betLenBytes[:], uint32(len(betBytes)))
+		buf.Write(betLenBytes[:])
+		buf.Write(betBytes)
+	}
+
+	return buf.Bytes()
+}
+
+// gzipCompress compresses data, returning an error if the gzip writer
+// itself fails (not if compression merely fails to shrink the input).
+func gzipCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipDecompress reverses gzipCompress.
+func gzipDecompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// SerializeBatch encodes a slice of Bets as a complete BATCH frame
+// carrying reqID. seq is the monotonically increasing batch sequence
+// number this client assigns, which lets the server deduplicate a batch
+// it already applied if a resumed client resends it. When compress is
+// true the bet data is gzipped before being framed; the payload starts
+// with seq (8 bytes big-endian), then a 1-byte compression flag and the
+// uncompressed/compressed body lengths (4 bytes big-endian each), so a
+// reader can allocate and decompress in one pass.
+func (p Protocol) SerializeBatch(reqID uint32, seq uint64, bets []Bet, compress bool) []byte {
 	if len(bets) == 0 {
-		return ""
+		return nil
 	}
-	
-	result := fmt.Sprintf("BATCH#%d\n", len(bets))
-	for _, bet := range bets {
-		betStr := p.SerializeBet(bet)
-		result += betStr
+
+	raw := batchBody(bets)
+	flag := batchBodyRaw
+	body := raw
+
+	if compress {
+		compressed, err := gzipCompress(raw)
+		if err == nil {
+			flag = batchBodyGzip
+			body = compressed
+		}
+	}
+
+	var buf bytes.Buffer
+	var seqBytes [8]byte
+	binary.BigEndian.PutUint64(seqBytes[:], seq)
+	buf.Write(seqBytes[:])
+	buf.WriteByte(flag)
+	var lenBytes [8]byte
+	binary.BigEndian.PutUint32(lenBytes[0:4], uint32(len(raw)))
+	binary.BigEndian.PutUint32(lenBytes[4:8], uint32(len(body)))
+	buf.Write(lenBytes[:])
+	buf.Write(body)
+
+	return frame(MsgTypeBatch, reqID, buf.Bytes())
+}
+
+// DeserializeBatch decodes a BATCH frame's payload back into its
+// sequence number and the slice of Bets it carries, transparently
+// gzip-decompressing the body if it was sent compressed.
+func (p Protocol) DeserializeBatch(payload []byte) (uint64, []Bet, error) {
+	if len(payload) < 17 {
+		return 0, nil, errors.New("protocol: truncated batch header")
+	}
+	seq := binary.BigEndian.Uint64(payload[0:8])
+	flag := payload[8]
+	uncompressedLen := binary.BigEndian.Uint32(payload[9:13])
+	compressedLen := binary.BigEndian.Uint32(payload[13:17])
+	if 17+int(compressedLen) > len(payload) {
+		return 0, nil, errors.New("protocol: truncated batch body")
+	}
+	body := payload[17 : 17+compressedLen]
+
+	raw := body
+	if flag == batchBodyGzip {
+		decompressed, err := gzipDecompress(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		raw = decompressed
+	}
+	if uint32(len(raw)) != uncompressedLen {
+		return 0, nil, errors.New("protocol: batch body length mismatch")
 	}
-	return result
+
+	if len(raw) < 4 {
+		return 0, nil, errors.New("protocol: truncated batch count")
+	}
+	count := int(binary.BigEndian.Uint32(raw[0:4]))
+	offset := 4
+
+	bets := make([]Bet, 0, count)
+	for i := 0; i < count; i++ {
+		if offset+4 > len(raw) {
+			return 0, nil, errors.New("protocol: truncated bet length")
+		}
+		betLen := int(binary.BigEndian.Uint32(raw[offset : offset+4]))
+		offset += 4
+		if offset+betLen > len(raw) {
+			return 0, nil, errors.New("protocol: truncated bet payload")
+		}
+		bet, err := deserializeBetPayload(raw[offset : offset+betLen])
+		if err != nil {
+			return 0, nil, err
+		}
+		bets = append(bets, bet)
+		offset += betLen
+	}
+
+	return seq, bets, nil
+}
+
+// SerializeFinishBets encodes a complete FINISH_BETS frame carrying
+// reqID, notifying the server that the agency has finished sending all
+// its bets.
+func (p Protocol) SerializeFinishBets(reqID uint32, agency string) []byte {
+	var buf bytes.Buffer
+	putTLV(&buf, agency)
+	return frame(MsgTypeFinishBets, reqID, buf.Bytes())
+}
+
+// DeserializeFinishBets decodes a FINISH_BETS frame's payload back into
+// the agency it refers to.
+func (p Protocol) DeserializeFinishBets(payload []byte) (string, error) {
+	agency, _, err := getTLV(payload, 0)
+	return agency, err
 }
 
-// SerializeFinishBets creates a FINISH_BETS message to notify the server
-// that the agency has finished sending all its bets
-func (p Protocol) SerializeFinishBets(agency string) string {
-	return fmt.Sprintf("FINISH_BETS#%s\n", p.escape(agency))
+// SerializeQueryWinners encodes a complete QUERY_WINNERS frame carrying
+// reqID, requesting the list of winners for a specific agency.
+func (p Protocol) SerializeQueryWinners(reqID uint32, agency string) []byte {
+	var buf bytes.Buffer
+	putTLV(&buf, agency)
+	return frame(MsgTypeQueryWinners, reqID, buf.Bytes())
+}
+
+// DeserializeQueryWinners decodes a QUERY_WINNERS frame's payload back
+// into the agency it refers to.
+func (p Protocol) DeserializeQueryWinners(payload []byte) (string, error) {
+	agency, _, err := getTLV(payload, 0)
+	return agency, err
+}
+
+// SerializeSubscribe encodes a complete SUBSCRIBE frame carrying reqID,
+// asking the server to register agency as a subscriber of topic.
+func (p Protocol) SerializeSubscribe(reqID uint32, agency, topic string) []byte {
+	var buf bytes.Buffer
+	putTLV(&buf, agency)
+	putTLV(&buf, topic)
+	return frame(MsgTypeSubscribe, reqID, buf.Bytes())
+}
+
+// DeserializeSubscribe decodes a SUBSCRIBE frame's payload back into the
+// agency and topic it refers to.
+func (p Protocol) DeserializeSubscribe(payload []byte) (agency, topic string, err error) {
+	agency, offset, err := getTLV(payload, 0)
+	if err != nil {
+		return "", "", err
+	}
+	topic, _, err = getTLV(payload, offset)
+	return agency, topic, err
+}
+
+// SerializePublish encodes a complete PUBLISH frame carrying reqID,
+// asking the server to fan out data to every subscriber of topic. data
+// is length-prefixed with a 4-byte field (see putTLV32), since unlike a
+// bet's fields its size isn't bounded ahead of time.
+func (p Protocol) SerializePublish(reqID uint32, topic string, data []byte) []byte {
+	var buf bytes.Buffer
+	putTLV(&buf, topic)
+	putTLV32(&buf, data)
+	return frame(MsgTypePublish, reqID, buf.Bytes())
+}
+
+// DeserializePublish decodes a PUBLISH frame's payload back into the
+// topic and data it carries.
+func (p Protocol) DeserializePublish(payload []byte) (topic string, data []byte, err error) {
+	topic, offset, err := getTLV(payload, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	data, _, err = getTLV32(payload, offset)
+	return topic, data, err
 }
 
-// SerializeQueryWinners creates a QUERY_WINNERS message to request
-// the list of winners for a specific agency
-func (p Protocol) SerializeQueryWinners(agency string) string {
-	return fmt.Sprintf("QUERY_WINNERS#%s\n", p.escape(agency))
+// SerializeMessage encodes a complete MESSAGE frame delivering a single
+// published item to a subscriber. It is pushed by the server on its own
+// initiative rather than in reply to a particular client request, so
+// reqID is conventionally 0. data uses the same 4-byte length prefix as
+// SerializePublish for the same reason.
+func (p Protocol) SerializeMessage(reqID uint32, topic string, data []byte) []byte {
+	var buf bytes.Buffer
+	putTLV(&buf, topic)
+	putTLV32(&buf, data)
+	return frame(MsgTypeMessage, reqID, buf.Bytes())
+}
+
+// DeserializeMessage decodes a MESSAGE frame's payload back into the
+// topic and data it carries.
+func (p Protocol) DeserializeMessage(payload []byte) (topic string, data []byte, err error) {
+	topic, offset, err := getTLV(payload, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	data, _, err = getTLV32(payload, offset)
+	return topic, data, err
+}
+
+// SerializeHello encodes a complete HELLO frame carrying reqID,
+// announcing clientID and a comma-separated list of capabilities (e.g.
+// "gzip,binary") this side of the connection supports. Client and server
+// exchange HELLO once at connection setup to negotiate which optional
+// features, such as batch compression, may be used for the rest of the
+// session.
+func (p Protocol) SerializeHello(reqID uint32, clientID, capabilities string) []byte {
+	var buf bytes.Buffer
+	putTLV(&buf, clientID)
+	putTLV(&buf, capabilities)
+	return frame(MsgTypeHello, reqID, buf.Bytes())
+}
+
+// DeserializeHello decodes a HELLO frame's payload back into the peer id
+// and capabilities it advertises.
+func (p Protocol) DeserializeHello(payload []byte) (clientID, capabilities string, err error) {
+	clientID, offset, err := getTLV(payload, 0)
+	if err != nil {
+		return "", "", err
+	}
+	capabilities, _, err = getTLV(payload, offset)
+	return clientID, capabilities, err
+}
+
+// SerializeResume encodes a complete RESUME frame carrying reqID, asking
+// the server for the correct point to resume from when agency's local
+// checkpoint of the highest acknowledged batch sequence number is
+// missing or might be stale. lastSeq is the local checkpoint, or 0 if
+// there is none.
+func (p Protocol) SerializeResume(reqID uint32, agency string, lastSeq uint64) []byte {
+	var buf bytes.Buffer
+	putTLV(&buf, agency)
+	var seqBytes [8]byte
+	binary.BigEndian.PutUint64(seqBytes[:], lastSeq)
+	buf.Write(seqBytes[:])
+	return frame(MsgTypeResume, reqID, buf.Bytes())
+}
+
+// DeserializeResume decodes a RESUME frame's payload back into the
+// agency and last-acknowledged sequence number it carries.
+func (p Protocol) DeserializeResume(payload []byte) (agency string, lastSeq uint64, err error) {
+	agency, offset, err := getTLV(payload, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	if offset+8 > len(payload) {
+		return "", 0, errors.New("protocol: truncated resume sequence")
+	}
+	lastSeq = binary.BigEndian.Uint64(payload[offset : offset+8])
+	return agency, lastSeq, nil
+}
+
+// maxFrameLength bounds the length prefix ReadFrame will trust enough to
+// allocate a buffer for, so a corrupted or adversarial length field can't
+// force a multi-gigabyte allocation. Generous enough for the largest
+// realistic batch, even gzip-compressed.
+const maxFrameLength = 64 * 1024 * 1024
+
+// ReadFrame reads one complete frame from r, returning its message type,
+// request id and payload. It blocks until the whole frame has arrived,
+// so callers never need to handle short reads themselves.
+func ReadFrame(r io.Reader) (byte, uint32, []byte, error) {
+	var lenBytes [4]byte
+	if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(lenBytes[:])
+	if length < 5 {
+		return 0, 0, nil, fmt.Errorf("protocol: invalid frame length %d", length)
+	}
+	if length > maxFrameLength {
+		return 0, 0, nil, fmt.Errorf("protocol: frame length %d exceeds max %d", length, maxFrameLength)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	msgType := body[0]
+	reqID := binary.BigEndian.Uint32(body[1:5])
+	return msgType, reqID, body[5:], nil
 }
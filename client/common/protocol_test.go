@@ -0,0 +1,239 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func sampleBet() Bet {
+	return Bet{
+		Agency:    "1",
+		FirstName: "Santiago",
+		LastName:  "Lionel Gomez",
+		Document:  "30904455",
+		Birthdate: "1999-03-17",
+		Number:    "7574",
+	}
+}
+
+func TestBetRoundTrip(t *testing.T) {
+	proto := Protocol{}
+	b := sampleBet()
+
+	frameBytes := proto.SerializeBet(42, b)
+
+	msgType, reqID, payload, err := ReadFrame(bytes.NewReader(frameBytes))
+	if err != nil {
+		t.Fatalf("ReadFrame returned error: %v", err)
+	}
+	if msgType != MsgTypeBet {
+		t.Fatalf("msgType = %d, want %d", msgType, MsgTypeBet)
+	}
+	if reqID != 42 {
+		t.Fatalf("reqID = %d, want 42", reqID)
+	}
+
+	got, err := proto.DeserializeBet(payload)
+	if err != nil {
+		t.Fatalf("DeserializeBet returned error: %v", err)
+	}
+	if got != b {
+		t.Fatalf("DeserializeBet = %+v, want %+v", got, b)
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	proto := Protocol{}
+	bets := []Bet{sampleBet(), sampleBet(), sampleBet()}
+	bets[1].Number = "1"
+	bets[2].Number = "2"
+
+	for _, compress := range []bool{false, true} {
+		frameBytes := proto.SerializeBatch(7, 3, bets, compress)
+
+		msgType, reqID, payload, err := ReadFrame(bytes.NewReader(frameBytes))
+		if err != nil {
+			t.Fatalf("compress=%v: ReadFrame returned error: %v", compress, err)
+		}
+		if msgType != MsgTypeBatch {
+			t.Fatalf("compress=%v: msgType = %d, want %d", compress, msgType, MsgTypeBatch)
+		}
+		if reqID != 7 {
+			t.Fatalf("compress=%v: reqID = %d, want 7", compress, reqID)
+		}
+
+		seq, got, err := proto.DeserializeBatch(payload)
+		if err != nil {
+			t.Fatalf("compress=%v: DeserializeBatch returned error: %v", compress, err)
+		}
+		if seq != 3 {
+			t.Fatalf("compress=%v: seq = %d, want 3", compress, seq)
+		}
+		if len(got) != len(bets) {
+			t.Fatalf("compress=%v: got %d bets, want %d", compress, len(got), len(bets))
+		}
+		for i := range bets {
+			if got[i] != bets[i] {
+				t.Fatalf("compress=%v: bet[%d] = %+v, want %+v", compress, i, got[i], bets[i])
+			}
+		}
+	}
+}
+
+func TestBatchEmptyReturnsNil(t *testing.T) {
+	proto := Protocol{}
+	if frameBytes := proto.SerializeBatch(1, 1, nil, false); frameBytes != nil {
+		t.Fatalf("SerializeBatch(nil) = %v, want nil", frameBytes)
+	}
+}
+
+func TestFinishBetsRoundTrip(t *testing.T) {
+	proto := Protocol{}
+	frameBytes := proto.SerializeFinishBets(5, "1")
+
+	msgType, reqID, payload, err := ReadFrame(bytes.NewReader(frameBytes))
+	if err != nil {
+		t.Fatalf("ReadFrame returned error: %v", err)
+	}
+	if msgType != MsgTypeFinishBets {
+		t.Fatalf("msgType = %d, want %d", msgType, MsgTypeFinishBets)
+	}
+	if reqID != 5 {
+		t.Fatalf("reqID = %d, want 5", reqID)
+	}
+
+	agency, err := proto.DeserializeFinishBets(payload)
+	if err != nil {
+		t.Fatalf("DeserializeFinishBets returned error: %v", err)
+	}
+	if agency != "1" {
+		t.Fatalf("agency = %q, want %q", agency, "1")
+	}
+}
+
+func TestQueryWinnersRoundTrip(t *testing.T) {
+	proto := Protocol{}
+	frameBytes := proto.SerializeQueryWinners(9, "2")
+
+	_, _, payload, err := ReadFrame(bytes.NewReader(frameBytes))
+	if err != nil {
+		t.Fatalf("ReadFrame returned error: %v", err)
+	}
+
+	agency, err := proto.DeserializeQueryWinners(payload)
+	if err != nil {
+		t.Fatalf("DeserializeQueryWinners returned error: %v", err)
+	}
+	if agency != "2" {
+		t.Fatalf("agency = %q, want %q", agency, "2")
+	}
+}
+
+func TestSubscribeRoundTrip(t *testing.T) {
+	proto := Protocol{}
+	frameBytes := proto.SerializeSubscribe(3, "1", "winners")
+
+	_, _, payload, err := ReadFrame(bytes.NewReader(frameBytes))
+	if err != nil {
+		t.Fatalf("ReadFrame returned error: %v", err)
+	}
+
+	agency, topic, err := proto.DeserializeSubscribe(payload)
+	if err != nil {
+		t.Fatalf("DeserializeSubscribe returned error: %v", err)
+	}
+	if agency != "1" || topic != "winners" {
+		t.Fatalf("got agency=%q topic=%q, want agency=%q topic=%q", agency, topic, "1", "winners")
+	}
+}
+
+func TestPublishAndMessageRoundTrip(t *testing.T) {
+	proto := Protocol{}
+	// Larger than a 16-bit TLV length field could hold, to guard against
+	// the data payload silently wrapping and corrupting the frame.
+	data := bytes.Repeat([]byte{0xAB}, 70000)
+
+	for _, tc := range []struct {
+		name        string
+		serialize   func() []byte
+		wantType    byte
+		deserialize func([]byte) (string, []byte, error)
+	}{
+		{"Publish", func() []byte { return proto.SerializePublish(1, "winners", data) }, MsgTypePublish, proto.DeserializePublish},
+		{"Message", func() []byte { return proto.SerializeMessage(0, "winners", data) }, MsgTypeMessage, proto.DeserializeMessage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			frameBytes := tc.serialize()
+
+			msgType, _, payload, err := ReadFrame(bytes.NewReader(frameBytes))
+			if err != nil {
+				t.Fatalf("ReadFrame returned error: %v", err)
+			}
+			if msgType != tc.wantType {
+				t.Fatalf("msgType = %d, want %d", msgType, tc.wantType)
+			}
+
+			topic, gotData, err := tc.deserialize(payload)
+			if err != nil {
+				t.Fatalf("deserialize returned error: %v", err)
+			}
+			if topic != "winners" {
+				t.Fatalf("topic = %q, want %q", topic, "winners")
+			}
+			if !bytes.Equal(gotData, data) {
+				t.Fatalf("data round-trip mismatch: got %d bytes, want %d bytes", len(gotData), len(data))
+			}
+		})
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	proto := Protocol{}
+	frameBytes := proto.SerializeHello(1, "1", "gzip,binary")
+
+	_, _, payload, err := ReadFrame(bytes.NewReader(frameBytes))
+	if err != nil {
+		t.Fatalf("ReadFrame returned error: %v", err)
+	}
+
+	clientID, capabilities, err := proto.DeserializeHello(payload)
+	if err != nil {
+		t.Fatalf("DeserializeHello returned error: %v", err)
+	}
+	if clientID != "1" || capabilities != "gzip,binary" {
+		t.Fatalf("got clientID=%q capabilities=%q, want clientID=%q capabilities=%q",
+			clientID, capabilities, "1", "gzip,binary")
+	}
+}
+
+func TestResumeRoundTrip(t *testing.T) {
+	proto := Protocol{}
+	frameBytes := proto.SerializeResume(1, "1", 12345)
+
+	_, _, payload, err := ReadFrame(bytes.NewReader(frameBytes))
+	if err != nil {
+		t.Fatalf("ReadFrame returned error: %v", err)
+	}
+
+	agency, lastSeq, err := proto.DeserializeResume(payload)
+	if err != nil {
+		t.Fatalf("DeserializeResume returned error: %v", err)
+	}
+	if agency != "1" || lastSeq != 12345 {
+		t.Fatalf("got agency=%q lastSeq=%d, want agency=%q lastSeq=%d", agency, lastSeq, "1", 12345)
+	}
+}
+
+// TestReadFrameRejectsOversizedLength checks that ReadFrame rejects a
+// length prefix above maxFrameLength before allocating a buffer for it,
+// rather than trusting a corrupted or adversarial field.
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	var lenBytes [4]byte
+	binary.BigEndian.PutUint32(lenBytes[:], maxFrameLength+1)
+
+	_, _, _, err := ReadFrame(bytes.NewReader(lenBytes[:]))
+	if err == nil {
+		t.Fatal("ReadFrame with an oversized length prefix returned no error")
+	}
+}